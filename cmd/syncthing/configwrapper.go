@@ -0,0 +1,191 @@
+package main
+
+import "sync"
+
+// Committer is implemented by anything that needs to react to a live
+// configuration change. VerifyConfiguration is called on every committer
+// before any of them commits, so that any one of them can veto the change
+// before it is applied anywhere. CommitConfiguration applies an already
+// verified change and returns false if it could not be applied live, in
+// which case a restart is required before it takes full effect.
+type Committer interface {
+	VerifyConfiguration(from, to Configuration) error
+	CommitConfiguration(from, to Configuration) bool
+}
+
+// ConfigWrapper serializes changes to the running Configuration and notifies
+// subscribers of them, so that some configuration edits can take effect
+// without restarting the process. With the subscribers main registers, added
+// repositories and node list changes apply live and the listeners follow
+// ListenAddress. A changed GUI configuration, a changed MaxSendKbps or
+// MaxRecvKbps (which only new connections pick up), changed discovery
+// settings including ListenAddress, or a removed or changed repository
+// still make RequiresRestart report true.
+type ConfigWrapper struct {
+	mut             sync.Mutex
+	subscribers     []Committer
+	requiresRestart bool
+}
+
+var configWrapper = &ConfigWrapper{}
+
+// Subscribe registers c to be consulted on, and notified of, future
+// configuration changes.
+func (w *ConfigWrapper) Subscribe(c Committer) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	w.subscribers = append(w.subscribers, c)
+}
+
+// Raw returns a copy of the currently active configuration.
+func (w *ConfigWrapper) Raw() Configuration {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	return cfg
+}
+
+// Replace makes to the new running configuration. Every subscriber gets a
+// chance to veto the change with VerifyConfiguration before any of them see
+// it applied; the first error aborts the whole replace and cfg is left
+// unchanged. Otherwise the change is saved to disk and every subscriber is
+// given a chance to apply it live via CommitConfiguration. A subscriber
+// that returns false means the change requires a restart to take full
+// effect, which is then reflected by RequiresRestart.
+func (w *ConfigWrapper) Replace(to Configuration) error {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	from := cfg
+	for _, sub := range w.subscribers {
+		if err := sub.VerifyConfiguration(from, to); err != nil {
+			return err
+		}
+	}
+
+	cfg = to
+	saveConfig()
+
+	w.requiresRestart = false
+	for _, sub := range w.subscribers {
+		if !sub.CommitConfiguration(from, to) {
+			w.requiresRestart = true
+		}
+	}
+
+	return nil
+}
+
+// RequiresRestart reports whether the most recently committed change
+// contained something that some subscriber could not apply live.
+func (w *ConfigWrapper) RequiresRestart() bool {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	return w.requiresRestart
+}
+
+// modelCommitter adds newly configured repositories live. Removing a
+// repository, or changing the directory, node list or read-only flag of an
+// existing one, still requires a restart - the model has no API for
+// tearing a repository down or moving one that's already running.
+type modelCommitter struct {
+	model *Model
+}
+
+func (c *modelCommitter) VerifyConfiguration(from, to Configuration) error {
+	return nil
+}
+
+func (c *modelCommitter) CommitConfiguration(from, to Configuration) bool {
+	fromRepos := make(map[string]RepositoryConfiguration, len(from.Repositories))
+	for _, repo := range from.Repositories {
+		fromRepos[repo.ID] = repo
+	}
+
+	restartNeeded := false
+
+	for _, repo := range to.Repositories {
+		old, existed := fromRepos[repo.ID]
+		if !existed {
+			repo.Nodes = cleanNodeList(repo.Nodes, myID)
+			dir := expandTilde(repo.Directory)
+			ensureDir(dir, -1)
+			c.model.AddRepo(repo.ID, dir, repo.Nodes)
+			if repo.ReadOnly {
+				c.model.StartRepoRO(repo.ID)
+			} else {
+				c.model.StartRepoRW(repo.ID, to.Options.ParallelRequests)
+			}
+			continue
+		}
+
+		delete(fromRepos, repo.ID)
+		if !sameRepoConfig(old, repo) {
+			restartNeeded = true
+		}
+	}
+
+	// Anything left in fromRepos was dropped from to.Repositories.
+	if len(fromRepos) > 0 {
+		restartNeeded = true
+	}
+
+	return !restartNeeded
+}
+
+// sameRepoConfig reports whether a and b describe the same repository as
+// far as the running model is concerned: same directory, same read-only
+// mode and the same node IDs in the same order.
+func sameRepoConfig(a, b RepositoryConfiguration) bool {
+	if a.Directory != b.Directory || a.ReadOnly != b.ReadOnly {
+		return false
+	}
+	if len(a.Nodes) != len(b.Nodes) {
+		return false
+	}
+	for i := range a.Nodes {
+		if a.Nodes[i].NodeID != b.Nodes[i].NodeID {
+			return false
+		}
+	}
+	return true
+}
+
+// discoveryCommitter reports whether the discovery-related options changed.
+// The discover.Discoverer we have today has no way to change its listen
+// addresses or announcement settings once started, so any such change
+// requires a restart.
+type discoveryCommitter struct{}
+
+func (c *discoveryCommitter) VerifyConfiguration(from, to Configuration) error {
+	return nil
+}
+
+func (c *discoveryCommitter) CommitConfiguration(from, to Configuration) bool {
+	sameAddrs := len(from.Options.ListenAddress) == len(to.Options.ListenAddress)
+	if sameAddrs {
+		for i := range from.Options.ListenAddress {
+			if from.Options.ListenAddress[i] != to.Options.ListenAddress[i] {
+				sameAddrs = false
+				break
+			}
+		}
+	}
+
+	return sameAddrs &&
+		from.Options.LocalAnnEnabled == to.Options.LocalAnnEnabled &&
+		from.Options.GlobalAnnEnabled == to.Options.GlobalAnnEnabled &&
+		from.Options.GlobalAnnServer == to.Options.GlobalAnnServer
+}
+
+// guiCommitter reports whether the GUI configuration changed. startGUI has
+// no corresponding stop, so a change still requires a restart to take full
+// effect.
+type guiCommitter struct{}
+
+func (c *guiCommitter) VerifyConfiguration(from, to Configuration) error {
+	return nil
+}
+
+func (c *guiCommitter) CommitConfiguration(from, to Configuration) bool {
+	return from.GUI == to.GUI
+}
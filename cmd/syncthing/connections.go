@@ -0,0 +1,426 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/calmh/syncthing/protocol"
+	"github.com/thejerf/suture"
+)
+
+// connectionSvc is the top-level supervisor for everything related to
+// keeping connections to other nodes up: listening, dialing out, and
+// dispatching handshaked connections to the model. It replaces the bare
+// goroutines that used to be spawned from listenConnect, so that a panic in
+// one of them gets logged and the subsystem restarted instead of silently
+// leaving the process half-broken.
+type connectionSvc struct {
+	*suture.Supervisor
+	listeners *listenerSupervisor
+}
+
+// newConnectionService creates the top-level supervisor and starts the
+// config-saver right away, since saveConfig can be called (e.g. when
+// writing the initial template configuration) before a TLS configuration
+// and model are available to set up listening and dialing.
+func newConnectionService(cfgFile string) *connectionSvc {
+	svc := &connectionSvc{
+		Supervisor: suture.New("connections", suture.Spec{
+			Log: func(line string) {
+				infoln("connections:", line)
+			},
+		}),
+	}
+	svc.Add(newConfigSaverSvc(cfgFile))
+	return svc
+}
+
+// Start adds the listeners, the outgoing connector and the connection
+// dispatcher to the supervisor. It must be called once a TLS configuration
+// and model are ready, and before connections are expected to flow.
+func (s *connectionSvc) Start(myID string, m *Model, tlsCfg *tls.Config) {
+	conns := make(chan tlsConn)
+
+	s.listeners = newListenerSupervisor(tlsCfg, conns)
+	s.Add(s.listeners)
+	s.Add(newConnectorSvc(myID, m, tlsCfg, conns))
+	s.Add(newDispatcherSvc(myID, m, conns))
+	s.listeners.Sync(configWrapper.Raw().Options.ListenAddress)
+}
+
+// VerifyConfiguration is a no-op; any set of listen addresses is valid, a
+// bad one just fails to bind and gets logged and backed off by the
+// listenerSupervisor.
+func (s *connectionSvc) VerifyConfiguration(from, to Configuration) error {
+	return nil
+}
+
+// CommitConfiguration adds and removes listeners to match the new
+// ListenAddress list. It's always applied live.
+func (s *connectionSvc) CommitConfiguration(from, to Configuration) bool {
+	if s.listeners != nil {
+		s.listeners.Sync(to.Options.ListenAddress)
+	}
+	return true
+}
+
+// listenerSupervisor owns one genericListener per configured listen
+// address. FailureThreshold is set low and FailureBackoff high so that a
+// listener which keeps failing to bind (for example "address already in
+// use" right after a restart) gets suspended for a while instead of
+// hot-looping and filling the log.
+type listenerSupervisor struct {
+	*suture.Supervisor
+	tlsCfg *tls.Config
+	conns  chan<- tlsConn
+	tokens map[string]suture.ServiceToken
+}
+
+func newListenerSupervisor(tlsCfg *tls.Config, conns chan<- tlsConn) *listenerSupervisor {
+	return &listenerSupervisor{
+		Supervisor: suture.New("listeners", suture.Spec{
+			Log: func(line string) {
+				infoln("listeners:", line)
+			},
+			FailureThreshold: 2,
+			FailureBackoff:   10 * time.Minute,
+		}),
+		tlsCfg: tlsCfg,
+		conns:  conns,
+		tokens: make(map[string]suture.ServiceToken),
+	}
+}
+
+// Sync adds a genericListener for every address in addrs that doesn't
+// already have one, and removes any listener whose address is no longer
+// present. It is safe to call repeatedly, e.g. whenever the configuration
+// changes.
+func (s *listenerSupervisor) Sync(addrs []string) {
+	want := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		want[addr] = true
+		if _, ok := s.tokens[addr]; ok {
+			continue
+		}
+		s.tokens[addr] = s.Add(newGenericListener(addr, s.tlsCfg, s.conns))
+	}
+
+	for addr, token := range s.tokens {
+		if !want[addr] {
+			s.Remove(token)
+			delete(s.tokens, addr)
+		}
+	}
+}
+
+// genericListener listens on a single address and pushes handshaked
+// connections onto conns. It implements suture.Service.
+//
+// done is re-created at the top of every Serve call rather than just once
+// in the constructor: the listenerSupervisor's FailureThreshold and
+// FailureBackoff exist precisely so suture re-invokes Serve on the same
+// *genericListener after, say, a failed bind, and a done channel closed by
+// one Serve call would already be closed by the time the next one ran.
+type genericListener struct {
+	addr   string
+	tlsCfg *tls.Config
+	conns  chan<- tlsConn
+	stop   chan struct{}
+
+	mut      sync.Mutex
+	listener net.Listener
+	done     chan struct{}
+}
+
+func newGenericListener(addr string, tlsCfg *tls.Config, conns chan<- tlsConn) *genericListener {
+	return &genericListener{
+		addr:   addr,
+		tlsCfg: tlsCfg,
+		conns:  conns,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+func (l *genericListener) Serve() {
+	l.mut.Lock()
+	done := make(chan struct{})
+	l.done = done
+	l.mut.Unlock()
+	defer close(done)
+
+	if debugNet {
+		dlog.Println("listening on", l.addr)
+	}
+
+	rawListener, err := tls.Listen("tcp", l.addr, l.tlsCfg)
+	if err != nil {
+		warnln(err)
+		return
+	}
+	listener := &slowListener{rawListener}
+
+	l.mut.Lock()
+	l.listener = listener
+	l.mut.Unlock()
+	defer listener.Close()
+
+	select {
+	case <-l.stop:
+		// Stop() ran, and closed l.listener itself, before we got here.
+		return
+	default:
+	}
+
+	for {
+		rawConn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-l.stop:
+				return
+			default:
+				warnln(err)
+				continue
+			}
+		}
+
+		if debugNet {
+			dlog.Println("connect from", rawConn.RemoteAddr())
+		}
+
+		conn := rawConn.(tlsConn)
+		if err := conn.Handshake(); err != nil {
+			warnln(err)
+			conn.Close()
+			continue
+		}
+
+		l.conns <- conn
+	}
+}
+
+// Stop closes the listener, which unblocks Serve's Accept call, and waits
+// for the Serve call that's currently running, if any, to actually return
+// before returning itself.
+func (l *genericListener) Stop() {
+	close(l.stop)
+
+	l.mut.Lock()
+	listener := l.listener
+	done := l.done
+	l.mut.Unlock()
+	if listener != nil {
+		listener.Close()
+	}
+
+	<-done
+}
+
+// connectorSvc periodically tries to dial every configured node that we're
+// not already connected to, pushing handshaked connections onto conns. It
+// implements suture.Service.
+type connectorSvc struct {
+	myID   string
+	m      *Model
+	tlsCfg *tls.Config
+	conns  chan<- tlsConn
+	stop   chan struct{}
+}
+
+func newConnectorSvc(myID string, m *Model, tlsCfg *tls.Config, conns chan<- tlsConn) *connectorSvc {
+	return &connectorSvc{
+		myID:   myID,
+		m:      m,
+		tlsCfg: tlsCfg,
+		conns:  conns,
+		stop:   make(chan struct{}),
+	}
+}
+
+func (c *connectorSvc) Serve() {
+	for {
+		raw := configWrapper.Raw()
+
+	nextNode:
+		for _, nodeCfg := range raw.Nodes {
+			if nodeCfg.NodeID == c.myID {
+				continue
+			}
+			if c.m.ConnectedTo(nodeCfg.NodeID) {
+				continue
+			}
+
+			var addrs []string
+			for _, addr := range nodeCfg.Addresses {
+				if addr == "dynamic" {
+					if discoverer != nil {
+						t := discoverer.Lookup(nodeCfg.NodeID)
+						if len(t) == 0 {
+							continue
+						}
+						addrs = append(addrs, t...)
+					}
+				} else {
+					addrs = append(addrs, addr)
+				}
+			}
+
+			for _, addr := range addrs {
+				host, port, err := net.SplitHostPort(addr)
+				if err != nil && strings.HasPrefix(err.Error(), "missing port") {
+					// addr is on the form "1.2.3.4"
+					addr = net.JoinHostPort(addr, "22000")
+				} else if err == nil && port == "" {
+					// addr is on the form "1.2.3.4:"
+					addr = net.JoinHostPort(host, "22000")
+				}
+				if debugNet {
+					dlog.Println("dial", nodeCfg.NodeID, addr)
+				}
+				conn, err := dialThrottled(addr, c.tlsCfg)
+				if err != nil {
+					if debugNet {
+						dlog.Println(err)
+					}
+					continue
+				}
+
+				c.conns <- conn
+				continue nextNode
+			}
+		}
+
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(time.Duration(raw.Options.ReconnectIntervalS) * time.Second):
+		}
+	}
+}
+
+func (c *connectorSvc) Stop() {
+	close(c.stop)
+}
+
+// dispatcherSvc reads handshaked connections off conns, matches them against
+// the configured node list, and hands them to the model. It implements
+// suture.Service.
+type dispatcherSvc struct {
+	myID  string
+	m     *Model
+	conns <-chan tlsConn
+	stop  chan struct{}
+}
+
+func newDispatcherSvc(myID string, m *Model, conns <-chan tlsConn) *dispatcherSvc {
+	return &dispatcherSvc{
+		myID:  myID,
+		m:     m,
+		conns: conns,
+		stop:  make(chan struct{}),
+	}
+}
+
+func (d *dispatcherSvc) Serve() {
+	for {
+		select {
+		case <-d.stop:
+			return
+		case conn := <-d.conns:
+			d.handle(conn)
+		}
+	}
+}
+
+func (d *dispatcherSvc) Stop() {
+	close(d.stop)
+}
+
+// configSaverSvc persists cfg to disk whenever asked to via saveConfig. It
+// implements suture.Service.
+type configSaverSvc struct {
+	cfgFile string
+	stop    chan struct{}
+}
+
+func newConfigSaverSvc(cfgFile string) *configSaverSvc {
+	return &configSaverSvc{
+		cfgFile: cfgFile,
+		stop:    make(chan struct{}),
+	}
+}
+
+func (s *configSaverSvc) Serve() {
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-saveConfigCh:
+			s.save()
+		}
+	}
+}
+
+func (s *configSaverSvc) Stop() {
+	close(s.stop)
+}
+
+func (s *configSaverSvc) save() {
+	fd, err := os.Create(s.cfgFile + ".tmp")
+	if err != nil {
+		warnln(err)
+		return
+	}
+
+	if err := writeConfigXML(fd, configWrapper.Raw()); err != nil {
+		warnln(err)
+		fd.Close()
+		return
+	}
+
+	if err := fd.Close(); err != nil {
+		warnln(err)
+		return
+	}
+
+	if err := Rename(s.cfgFile+".tmp", s.cfgFile); err != nil {
+		warnln(err)
+	}
+}
+
+func (d *dispatcherSvc) handle(conn tlsConn) {
+	certs := conn.ConnectionState().PeerCertificates
+	if l := len(certs); l != 1 {
+		warnf("Got peer certificate list of length %d != 1; protocol error", l)
+		conn.Close()
+		return
+	}
+	remoteID := certID(certs[0].Raw)
+
+	if remoteID == d.myID {
+		warnf("Connected to myself (%s) - should not happen", remoteID)
+		conn.Close()
+		return
+	}
+
+	if d.m.ConnectedTo(remoteID) {
+		warnf("Connected to already connected node (%s)", remoteID)
+		conn.Close()
+		return
+	}
+
+	raw := configWrapper.Raw()
+	for _, nodeCfg := range raw.Nodes {
+		if nodeCfg.NodeID == remoteID {
+			applyNodeThrottle(conn, nodeCfg, raw.Options)
+			protoConn := protocol.NewConnection(remoteID, conn, conn, d.m)
+			d.m.AddConnection(conn, protoConn)
+			return
+		}
+	}
+	conn.Close()
+}
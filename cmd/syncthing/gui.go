@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// startGUI starts the web GUI listening on guiCfg.Address. Of its REST API,
+// only POST /rest/config is implemented here; it's the one endpoint this
+// series of changes cares about, since it's the other half (besides
+// SIGHUP) of how a running syncthing is meant to pick up a live
+// configuration change.
+func startGUI(guiCfg GUIConfiguration, m *Model) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rest/config", restConfig)
+
+	go func() {
+		if err := http.ListenAndServe(guiCfg.Address, mux); err != nil {
+			warnln("GUI:", err)
+		}
+	}()
+}
+
+// restConfig implements POST /rest/config: decode the submitted
+// configuration and hand it to the config wrapper to be verified and
+// applied live where possible, exactly like the SIGHUP handler does.
+func restConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var to Configuration
+	if err := json.NewDecoder(r.Body).Decode(&to); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := configWrapper.Replace(to); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{
+		"restartNeeded": configWrapper.RequiresRestart(),
+	})
+}
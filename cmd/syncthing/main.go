@@ -4,24 +4,22 @@ import (
 	"crypto/tls"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"runtime/debug"
 	"runtime/pprof"
-	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/calmh/syncthing/discover"
-	"github.com/calmh/syncthing/protocol"
-	"github.com/calmh/syncthing/upnp"
 	"github.com/juju/ratelimit"
 )
 
@@ -34,6 +32,7 @@ var (
 	myID       string
 	confDir    string
 	rateBucket *ratelimit.Bucket
+	recvBucket *ratelimit.Bucket
 	stop       = make(chan bool)
 	discoverer *discover.Discoverer
 )
@@ -110,10 +109,13 @@ func main() {
 	infoln("Version", Version)
 	infoln("My ID:", myID)
 
-	// Prepare to be able to save configuration
+	// Prepare to be able to save configuration. The connection supervisor
+	// starts the config-saver immediately so it's running before we might
+	// need to save a freshly generated template configuration below.
 
 	cfgFile := filepath.Join(confDir, "config.xml")
-	go saveConfigLoop(cfgFile)
+	connSvc := newConnectionService(cfgFile)
+	connSvc.ServeBackground()
 
 	// Load the configuration file, if it exists.
 	// If it does not, create a template.
@@ -180,12 +182,15 @@ func main() {
 		MinVersion:             tls.VersionTLS12,
 	}
 
-	// If the write rate should be limited, set up a rate limiter for it.
-	// This will be used on connections created in the connect and listen routines.
+	// If the send and/or receive rate should be limited, set up rate limiters
+	// for them. These will be used on connections created in the connect and
+	// listen routines. Going through the committer here too means that a
+	// later change to MaxSendKbps/MaxRecvKbps applies to connections made
+	// after it; connections already established keep their old limits.
 
-	if cfg.Options.MaxSendKbps > 0 {
-		rateBucket = ratelimit.NewBucketWithRate(float64(1000*cfg.Options.MaxSendKbps), int64(5*1000*cfg.Options.MaxSendKbps))
-	}
+	rlCommitter := &rateLimitCommitter{}
+	rlCommitter.CommitConfiguration(cfg, cfg)
+	configWrapper.Subscribe(rlCommitter)
 
 	m := NewModel(cfg.Options.MaxChangeKbps * 1000)
 
@@ -196,6 +201,10 @@ func main() {
 		m.AddRepo(cfg.Repositories[i].ID, dir, cfg.Repositories[i].Nodes)
 	}
 
+	configWrapper.Subscribe(&modelCommitter{model: m})
+	configWrapper.Subscribe(&discoveryCommitter{})
+	configWrapper.Subscribe(&guiCommitter{})
+
 	// GUI
 	if cfg.GUI.Enabled && cfg.GUI.Address != "" {
 		addr, err := net.ResolveTCPAddr("tcp", cfg.GUI.Address)
@@ -231,42 +240,41 @@ func main() {
 	m.ScanRepos()
 	m.SaveIndexes(confDir)
 
-	// UPnP
+	// NAT traversal. Set up incoming port forwarding, if necessary and
+	// possible, for every configured listen address - not just when there's
+	// a single one.
 
-	var externalPort = 0
-	if len(cfg.Options.ListenAddress) == 1 {
-		_, portStr, err := net.SplitHostPort(cfg.Options.ListenAddress[0])
-		if err != nil {
-			warnln(err)
-		} else {
-			// Set up incoming port forwarding, if necessary and possible
-			port, _ := strconv.Atoi(portStr)
-			igd, err := upnp.Discover()
-			if err == nil {
-				for i := 0; i < 10; i++ {
-					err := igd.AddPortMapping(upnp.TCP, port+i, port, "syncthing", 0)
-					if err == nil {
-						externalPort = port + i
-						infoln("Created UPnP port mapping - external port", externalPort)
-						break
-					}
-				}
-				if externalPort == 0 {
-					warnln("Failed to create UPnP port mapping")
-				}
-			} else {
-				infof("No UPnP IGD device found, no port mapping created (%v)", err)
-			}
-		}
-	} else {
-		warnln("Multiple listening addresses; not attempting UPnP port mapping")
-	}
+	natSvc := newNATService(cfg.Options.ListenAddress)
+	natSvc.refresh()
+	connSvc.Add(natSvc)
 
 	// Routine to connect out to configured nodes
-	discoverer = discovery(externalPort)
-	go listenConnect(myID, m, tlsCfg)
+	discoverer = discovery(natSvc.ExternalPorts())
+	connSvc.Start(myID, m, tlsCfg)
+	configWrapper.Subscribe(connSvc)
+
+	// SIGHUP reloads the configuration from disk and applies it live where
+	// possible. SIGINT/SIGTERM tear down NAT mappings before exiting.
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range sigChan {
+			switch sig {
+			case syscall.SIGHUP:
+				reloadConfig(cfgFile)
+			default:
+				infoln("Shutting down")
+				natSvc.Stop()
+				os.Exit(0)
+			}
+		}
+	}()
 
-	for _, repo := range cfg.Repositories {
+	// Read through the config wrapper rather than the cfg global: the
+	// SIGHUP handler above is already running and can call
+	// configWrapper.Replace, which reassigns cfg, concurrently with this.
+	raw := configWrapper.Raw()
+	for _, repo := range raw.Repositories {
 		// Routine to pull blocks from other nodes to synchronize the local
 		// repository. Does not run when we are in read only (publish only) mode.
 		if repo.ReadOnly {
@@ -274,7 +282,7 @@ func main() {
 			m.StartRepoRO(repo.ID)
 		} else {
 			okf("Ready to synchronize %s (read-write)", repo.ID)
-			m.StartRepoRW(repo.ID, cfg.Options.ParallelRequests)
+			m.StartRepoRW(repo.ID, raw.Options.ParallelRequests)
 		}
 	}
 
@@ -292,7 +300,7 @@ func main() {
 
 func resetRepositories() {
 	suffix := fmt.Sprintf(".syncthing-reset-%d", time.Now().UnixNano())
-	for _, repo := range cfg.Repositories {
+	for _, repo := range configWrapper.Raw().Repositories {
 		if _, err := os.Stat(repo.Directory); err == nil {
 			infof("Reset: Moving %s -> %s", repo.Directory, repo.Directory+suffix)
 			os.Rename(repo.Directory, repo.Directory+suffix)
@@ -340,169 +348,39 @@ func restart() {
 
 var saveConfigCh = make(chan struct{})
 
-func saveConfigLoop(cfgFile string) {
-	for _ = range saveConfigCh {
-		fd, err := os.Create(cfgFile + ".tmp")
-		if err != nil {
-			warnln(err)
-			continue
-		}
-
-		err = writeConfigXML(fd, cfg)
-		if err != nil {
-			warnln(err)
-			fd.Close()
-			continue
-		}
-
-		err = fd.Close()
-		if err != nil {
-			warnln(err)
-			continue
-		}
-
-		err = Rename(cfgFile+".tmp", cfgFile)
-		if err != nil {
-			warnln(err)
-		}
-	}
-}
-
 func saveConfig() {
 	saveConfigCh <- struct{}{}
 }
 
-func listenConnect(myID string, m *Model, tlsCfg *tls.Config) {
-	var conns = make(chan *tls.Conn)
+// reloadConfig re-reads cfgFile and, if it parses, hands it to the config
+// wrapper to be verified and applied live where possible.
+func reloadConfig(cfgFile string) {
+	infoln("Reloading configuration")
 
-	// Listen
-	for _, addr := range cfg.Options.ListenAddress {
-		addr := addr
-		go func() {
-			if debugNet {
-				dlog.Println("listening on", addr)
-			}
-			l, err := tls.Listen("tcp", addr, tlsCfg)
-			fatalErr(err)
-
-			for {
-				conn, err := l.Accept()
-				if err != nil {
-					warnln(err)
-					continue
-				}
-
-				if debugNet {
-					dlog.Println("connect from", conn.RemoteAddr())
-				}
-
-				tc := conn.(*tls.Conn)
-				err = tc.Handshake()
-				if err != nil {
-					warnln(err)
-					tc.Close()
-					continue
-				}
-
-				conns <- tc
-			}
-		}()
+	cf, err := os.Open(cfgFile)
+	if err != nil {
+		warnln("Could not reload configuration:", err)
+		return
 	}
+	defer cf.Close()
 
-	// Connect
-	go func() {
-		for {
-		nextNode:
-			for _, nodeCfg := range cfg.Nodes {
-				if nodeCfg.NodeID == myID {
-					continue
-				}
-				if m.ConnectedTo(nodeCfg.NodeID) {
-					continue
-				}
-
-				var addrs []string
-				for _, addr := range nodeCfg.Addresses {
-					if addr == "dynamic" {
-						if discoverer != nil {
-							t := discoverer.Lookup(nodeCfg.NodeID)
-							if len(t) == 0 {
-								continue
-							}
-							addrs = append(addrs, t...)
-						}
-					} else {
-						addrs = append(addrs, addr)
-					}
-				}
-
-				for _, addr := range addrs {
-					host, port, err := net.SplitHostPort(addr)
-					if err != nil && strings.HasPrefix(err.Error(), "missing port") {
-						// addr is on the form "1.2.3.4"
-						addr = net.JoinHostPort(addr, "22000")
-					} else if err == nil && port == "" {
-						// addr is on the form "1.2.3.4:"
-						addr = net.JoinHostPort(host, "22000")
-					}
-					if debugNet {
-						dlog.Println("dial", nodeCfg.NodeID, addr)
-					}
-					conn, err := tls.Dial("tcp", addr, tlsCfg)
-					if err != nil {
-						if debugNet {
-							dlog.Println(err)
-						}
-						continue
-					}
-
-					conns <- conn
-					continue nextNode
-				}
-			}
-
-			time.Sleep(time.Duration(cfg.Options.ReconnectIntervalS) * time.Second)
-		}
-	}()
-
-next:
-	for conn := range conns {
-		certs := conn.ConnectionState().PeerCertificates
-		if l := len(certs); l != 1 {
-			warnf("Got peer certificate list of length %d != 1; protocol error", l)
-			conn.Close()
-			continue
-		}
-		remoteID := certID(certs[0].Raw)
-
-		if remoteID == myID {
-			warnf("Connected to myself (%s) - should not happen", remoteID)
-			conn.Close()
-			continue
-		}
+	newCfg, err := readConfigXML(cf)
+	if err != nil {
+		warnln("Could not reload configuration:", err)
+		return
+	}
 
-		if m.ConnectedTo(remoteID) {
-			warnf("Connected to already connected node (%s)", remoteID)
-			conn.Close()
-			continue
-		}
+	if err := configWrapper.Replace(newCfg); err != nil {
+		warnln("Configuration change rejected:", err)
+		return
+	}
 
-		for _, nodeCfg := range cfg.Nodes {
-			if nodeCfg.NodeID == remoteID {
-				var wr io.Writer = conn
-				if rateBucket != nil {
-					wr = &limitedWriter{conn, rateBucket}
-				}
-				protoConn := protocol.NewConnection(remoteID, conn, wr, m)
-				m.AddConnection(conn, protoConn)
-				continue next
-			}
-		}
-		conn.Close()
+	if configWrapper.RequiresRestart() {
+		warnln("Some changes require a restart to take full effect")
 	}
 }
 
-func discovery(extPort int) *discover.Discoverer {
+func discovery(extPorts []int) *discover.Discoverer {
 	disc, err := discover.NewDiscoverer(myID, cfg.Options.ListenAddress)
 	if err != nil {
 		warnf("No discovery possible (%v)", err)
@@ -516,7 +394,11 @@ func discovery(extPort int) *discover.Discoverer {
 
 	if cfg.Options.GlobalAnnEnabled {
 		infoln("Sending global discovery announcements")
-		disc.StartGlobal(cfg.Options.GlobalAnnServer, uint16(extPort))
+		ports := make([]uint16, len(extPorts))
+		for i, port := range extPorts {
+			ports[i] = uint16(port)
+		}
+		disc.StartGlobal(cfg.Options.GlobalAnnServer, ports)
 	}
 
 	return disc
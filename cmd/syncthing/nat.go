@@ -0,0 +1,203 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/calmh/syncthing/upnp"
+)
+
+const (
+	// How often we try to (re-)establish and refresh port mappings when
+	// things are going well.
+	natRefreshInterval = 30 * time.Minute
+	// Backoff after a first failed attempt; it doubles with each further
+	// failure, up to natRefreshInterval.
+	natMinRetryInterval = 1 * time.Minute
+)
+
+// natService discovers an Internet Gateway Device and keeps a port mapping
+// alive for every configured listen address whose host is unspecified (all
+// interfaces) or a private LAN address. Mappings are refreshed on a ticker
+// and torn down when the service is stopped. It implements suture.Service.
+//
+// stop is created once, in the constructor, rather than in Serve: Stop is
+// called directly from the SIGINT/SIGTERM handler in main, bypassing
+// suture, and a signal arriving before the supervisor has scheduled the
+// first Serve call must not close a nil channel. done is instead
+// re-created at the top of every Serve call, since suture may re-invoke
+// Serve on this same instance after a panic, and a done channel
+// closed by one Serve call would already be closed by the time the next
+// one ran.
+type natService struct {
+	listenAddrs []string
+
+	mut      sync.Mutex
+	extPorts map[string]int // listen address -> external port
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newNATService(listenAddrs []string) *natService {
+	return &natService{
+		listenAddrs: listenAddrs,
+		extPorts:    make(map[string]int),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+func (s *natService) Serve() {
+	s.mut.Lock()
+	done := make(chan struct{})
+	s.done = done
+	s.mut.Unlock()
+	defer close(done)
+
+	interval := time.Duration(0)
+	for {
+		select {
+		case <-s.stop:
+			s.release()
+			return
+		case <-time.After(interval):
+		}
+
+		if s.refresh() {
+			interval = natRefreshInterval
+		} else if interval == 0 {
+			interval = natMinRetryInterval
+		} else if interval *= 2; interval > natRefreshInterval {
+			interval = natRefreshInterval
+		}
+	}
+}
+
+func (s *natService) Stop() {
+	close(s.stop)
+
+	s.mut.Lock()
+	done := s.done
+	s.mut.Unlock()
+	<-done
+}
+
+// ExternalPorts returns the external ports currently mapped, across all
+// listen addresses that got a mapping.
+func (s *natService) ExternalPorts() []int {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	ports := make([]int, 0, len(s.extPorts))
+	for _, port := range s.extPorts {
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+// refresh (re-)discovers an IGD and attempts, or renews, a mapping for
+// every eligible listen address. It returns false if discovery failed or no
+// mapping could be made at all, so the caller can back off.
+func (s *natService) refresh() bool {
+	igd, err := upnp.Discover()
+	if err != nil {
+		if debugNet {
+			dlog.Println("upnp:", err)
+		}
+		return false
+	}
+
+	ok := false
+	for _, addr := range s.listenAddrs {
+		if s.mapAddr(igd, addr) {
+			ok = true
+		}
+	}
+	return ok
+}
+
+func (s *natService) mapAddr(igd *upnp.IGD, addr string) bool {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		warnln(err)
+		return false
+	}
+
+	if host != "" {
+		ip := net.ParseIP(host)
+		if ip == nil || (!ip.IsUnspecified() && !isPrivateIP(ip)) {
+			// Not a candidate for port forwarding.
+			return false
+		}
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		warnln(err)
+		return false
+	}
+
+	s.mut.Lock()
+	extPort := s.extPorts[addr]
+	s.mut.Unlock()
+	if extPort == 0 {
+		extPort = port
+	}
+
+	for i := 0; i < 10; i++ {
+		candidate := extPort + i
+		if err := igd.AddPortMapping(upnp.TCP, port, candidate, "syncthing", int(natRefreshInterval/time.Second)*2); err == nil {
+			s.mut.Lock()
+			if s.extPorts[addr] != candidate {
+				infoln("Created UPnP port mapping -", addr, "-> external port", candidate)
+			}
+			s.extPorts[addr] = candidate
+			s.mut.Unlock()
+			return true
+		}
+	}
+
+	warnf("Failed to create UPnP port mapping for %s", addr)
+	return false
+}
+
+// release tears down every mapping we currently hold.
+func (s *natService) release() {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if len(s.extPorts) == 0 {
+		return
+	}
+
+	igd, err := upnp.Discover()
+	if err != nil {
+		warnln("upnp: could not tear down port mappings:", err)
+		return
+	}
+
+	for addr, extPort := range s.extPorts {
+		if err := igd.DeletePortMapping(upnp.TCP, extPort); err != nil {
+			warnf("Failed to remove UPnP port mapping for %s: %v", addr, err)
+		}
+		delete(s.extPorts, addr)
+	}
+}
+
+func isPrivateIP(ip net.IP) bool {
+	for _, cidr := range []string{
+		"10.0.0.0/8",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"fc00::/7",
+	} {
+		_, block, err := net.ParseCIDR(cidr)
+		if err == nil && block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}